@@ -0,0 +1,181 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+)
+
+// aggrLabelName is the synthetic label that distinguishes the aggregate
+// series emitted for a single input series, matching Thanos' downsampling
+// scheme.
+const aggrLabelName = "__aggr__"
+
+const (
+	aggrCount   = "count"
+	aggrSum     = "sum"
+	aggrMin     = "min"
+	aggrMax     = "max"
+	aggrCounter = "counter"
+)
+
+// aggrNames lists the aggregates written for every series, in the order
+// they should appear in the output block.
+var aggrNames = []string{aggrCount, aggrSum, aggrMin, aggrMax, aggrCounter}
+
+// aggrChunks holds one populated chunk per aggregate for a single input
+// series; every name in aggrNames has an entry. aggregateSeries returns a
+// nil aggrChunks instead when the series has no samples left after
+// tombstone filtering.
+type aggrChunks map[string]chunks.Meta
+
+// chunkSource is one input block's contribution of chunks to a (possibly
+// merged) series: the chunks themselves plus the reader they must be
+// fetched through, since chunk refs are only meaningful within the block
+// that produced them. intervals holds that series' tombstoned ranges in
+// this block, if any, so samples falling inside them can be dropped.
+type chunkSource struct {
+	reader    tsdb.ChunkReader
+	chks      []chunks.Meta
+	intervals tsdb.Intervals
+}
+
+// aggregateSeries buckets the samples of sources - read in the order
+// given, which callers must already have arranged in time order - by
+// floor(t/intervalMs) and reduces each bucket down to one sample per
+// aggregate; the counter aggregate additionally gets a carry point one
+// millisecond after each closed bucket that is followed by more samples.
+// Bucket timestamps are the last sample time in the bucket, matching
+// Thanos' convention.
+func aggregateSeries(sources []chunkSource, intervalMs int64) (aggrChunks, error) {
+	appenders := map[string]chunkenc.Appender{}
+	metas := aggrChunks{}
+	for _, name := range aggrNames {
+		c := chunkenc.NewXORChunk()
+		a, err := c.Appender()
+		if err != nil {
+			return nil, errors.Wrap(err, "create a chunk appender")
+		}
+		appenders[name] = a
+		metas[name] = chunks.Meta{Chunk: c}
+	}
+
+	var (
+		haveBucket   bool
+		bucket       int64
+		bucketLastT  int64
+		bucketCount  int64
+		bucketSum    float64
+		bucketMin    float64
+		bucketMax    float64
+		haveSample   bool
+		haveLast     bool
+		last         float64
+		acc          float64
+		pendingCarry float64
+		carryAfter   int64
+		haveCarry    bool
+	)
+
+	closeBucket := func() {
+		if !haveBucket || bucketCount == 0 {
+			return
+		}
+		t := bucketLastT
+		appenders[aggrCount].Append(t, float64(bucketCount))
+		appenders[aggrSum].Append(t, bucketSum)
+		appenders[aggrMin].Append(t, bucketMin)
+		appenders[aggrMax].Append(t, bucketMax)
+		counterVal := acc + last
+		appenders[aggrCounter].Append(t, counterVal)
+		pendingCarry = counterVal
+		carryAfter = t
+		haveCarry = true
+	}
+
+	var minTime, maxTime int64
+
+	for _, src := range sources {
+		for _, chk := range src.chks {
+			c, err := src.reader.Chunk(chk.Ref)
+			if err != nil {
+				return nil, errors.Wrap(err, "get a chunk")
+			}
+
+			iter := c.Iterator()
+			for iter.Next() {
+				t, v := iter.At()
+				if tombstoned(src.intervals, t) {
+					continue
+				}
+				if !haveSample {
+					minTime = t
+					haveSample = true
+				}
+				maxTime = t
+
+				b := t / intervalMs
+				if !haveBucket {
+					haveBucket = true
+					bucket = b
+					bucketCount = 0
+					bucketSum = 0
+					bucketMin = v
+					bucketMax = v
+				} else if b != bucket {
+					closeBucket()
+					bucket = b
+					bucketCount = 0
+					bucketSum = 0
+					bucketMin = v
+					bucketMax = v
+				}
+				bucketLastT = t
+
+				// Carry the previous bucket's closing counter value forward
+				// as an extra point right after the bucket boundary, so
+				// rate() spanning the gap between two downsampled counter
+				// points still sees the correct, reset-compensated delta
+				// instead of a jump back down to this bucket's raw value.
+				if haveCarry && t > carryAfter {
+					appenders[aggrCounter].Append(carryAfter+1, pendingCarry)
+					haveCarry = false
+				}
+
+				if haveLast && v < last {
+					acc += last
+				}
+				last = v
+				haveLast = true
+
+				bucketCount++
+				bucketSum += v
+				if v < bucketMin {
+					bucketMin = v
+				}
+				if v > bucketMax {
+					bucketMax = v
+				}
+			}
+			if err := iter.Err(); err != nil {
+				return nil, errors.Wrap(err, "iterate a chunk")
+			}
+		}
+	}
+
+	closeBucket()
+
+	if !haveSample {
+		return nil, nil
+	}
+
+	for _, name := range aggrNames {
+		m := metas[name]
+		m.MinTime = minTime
+		m.MaxTime = maxTime
+		metas[name] = m
+	}
+
+	return metas, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/ryotarai/prom-downsampler/bucket"
+)
+
+// candidateBlocks lists the block directories directly under the input
+// bucket whose meta.json doesn't already carry the target resolution,
+// i.e. blocks that are not themselves downsampled to this interval. A raw
+// block that was downsampled before, into a separate output block, is
+// listed again.
+func candidateBlocks(ctx context.Context, bkt bucket.Bucket, intervalMs int64) ([]string, error) {
+	var names []string
+	err := bkt.Iter(ctx, "", func(name string) error {
+		if !strings.HasSuffix(name, "/") {
+			return nil
+		}
+		name = strings.TrimSuffix(name, "/")
+
+		m, err := readBlockMeta(ctx, bkt, name)
+		if err != nil {
+			return errors.Wrapf(err, "read meta.json for %s", name)
+		}
+
+		if m.Thanos.Downsample.Resolution == intervalMs {
+			return nil
+		}
+
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func readBlockMeta(ctx context.Context, bkt bucket.Bucket, name string) (blockMeta, error) {
+	var m blockMeta
+
+	r, err := bkt.Get(ctx, name+"/meta.json")
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return m, errors.Wrap(err, "read meta.json")
+	}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, errors.Wrap(err, "unmarshal meta.json")
+	}
+	return m, nil
+}
+
+// fetchBlock downloads the index, meta.json and every chunks/ segment of
+// block name from bkt into a fresh directory under destDir, and returns
+// the local path tsdb.OpenBlock can be pointed at.
+func fetchBlock(ctx context.Context, bkt bucket.Bucket, name, destDir string) (string, error) {
+	localDir := filepath.Join(destDir, filepath.Base(name))
+	if err := os.MkdirAll(filepath.Join(localDir, "chunks"), 0777); err != nil {
+		return "", errors.Wrap(err, "os.MkdirAll")
+	}
+
+	if err := fetchObject(ctx, bkt, name+"/meta.json", filepath.Join(localDir, "meta.json")); err != nil {
+		return "", err
+	}
+	if err := fetchObject(ctx, bkt, name+"/index", filepath.Join(localDir, "index")); err != nil {
+		return "", err
+	}
+
+	err := bkt.Iter(ctx, name+"/chunks", func(segment string) error {
+		return fetchObject(ctx, bkt, name+"/chunks/"+segment, filepath.Join(localDir, "chunks", segment))
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "fetch chunks")
+	}
+
+	return localDir, nil
+}
+
+func fetchObject(ctx context.Context, bkt bucket.Bucket, key, dest string) error {
+	r, err := bkt.Get(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", key)
+	}
+	defer r.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", dest)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "write %s", dest)
+	}
+	return nil
+}
+
+// uploadBlock uploads meta.json, index and every chunks/ segment found
+// under localDir to bkt, under a key matching the block's directory name.
+func uploadBlock(ctx context.Context, bkt bucket.Bucket, localDir string) error {
+	name := filepath.Base(localDir)
+
+	if err := uploadFile(ctx, bkt, filepath.Join(localDir, "meta.json"), name+"/meta.json"); err != nil {
+		return err
+	}
+	if err := uploadFile(ctx, bkt, filepath.Join(localDir, "index"), name+"/index"); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(localDir, "chunks"))
+	if err != nil {
+		return errors.Wrap(err, "read chunks dir")
+	}
+	for _, e := range entries {
+		src := filepath.Join(localDir, "chunks", e.Name())
+		if err := uploadFile(ctx, bkt, src, name+"/chunks/"+e.Name()); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[INFO] Uploaded block %s to output bucket", name)
+	return nil
+}
+
+func uploadFile(ctx context.Context, bkt bucket.Bucket, src, key string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", src)
+	}
+	if err := bkt.Upload(ctx, key, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload %s", key)
+	}
+	return nil
+}
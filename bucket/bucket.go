@@ -0,0 +1,48 @@
+// Package bucket provides a minimal object-storage abstraction so the
+// downsampler can read and write blocks on local disk or in a remote
+// bucket (S3, ...) through the same interface.
+package bucket
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bucket is the subset of object-storage operations the downsampler
+// needs: fetching and uploading individual objects under a key, checking
+// whether one exists, and listing the objects/"directories" directly
+// under a prefix.
+type Bucket interface {
+	// Get returns a reader for the object at key. The caller must Close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Upload stores r under key, overwriting any existing object.
+	Upload(ctx context.Context, key string, r io.Reader) error
+	// Exists reports whether an object exists at key.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Iter calls fn once for every object/"subdirectory" directly under
+	// prefix, non-recursively. Subdirectory names end in "/".
+	Iter(ctx context.Context, prefix string, fn func(name string) error) error
+}
+
+// New parses a bucket URL such as "file:///var/blocks" or
+// "s3://bucket/prefix" and returns a Bucket rooted at it.
+func New(rawurl string) (Bucket, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse bucket url %q", rawurl)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return newFilesystemBucket(u.Path), nil
+	case "s3":
+		prefix := strings.TrimPrefix(u.Path, "/")
+		return newS3Bucket(u.Host, prefix)
+	default:
+		return nil, errors.Errorf("unsupported bucket scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,80 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// filesystemBucket implements Bucket on top of a local directory tree,
+// e.g. for "file:///var/blocks" URLs.
+type filesystemBucket struct {
+	root string
+}
+
+func newFilesystemBucket(root string) *filesystemBucket {
+	return &filesystemBucket{root: root}
+}
+
+func (b *filesystemBucket) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+func (b *filesystemBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", key)
+	}
+	return f, nil
+}
+
+func (b *filesystemBucket) Upload(ctx context.Context, key string, r io.Reader) error {
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return errors.Wrapf(err, "mkdir for %s", key)
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", key)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "write %s", key)
+	}
+	return nil
+}
+
+func (b *filesystemBucket) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(b.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "stat %s", key)
+	}
+	return true, nil
+}
+
+func (b *filesystemBucket) Iter(ctx context.Context, prefix string, fn func(name string) error) error {
+	entries, err := ioutil.ReadDir(b.path(prefix))
+	if err != nil {
+		return errors.Wrapf(err, "read dir %s", prefix)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// s3Bucket implements Bucket on top of S3 (or an S3-compatible store)
+// via minio-go, for "s3://bucket/prefix" URLs. Credentials and endpoint
+// are taken from the usual AWS environment variables so this tool needs
+// no S3-specific flags.
+type s3Bucket struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Bucket(bucket, prefix string) (*s3Bucket, error) {
+	endpoint := os.Getenv("AWS_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	client, err := minio.New(endpoint, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), true)
+	if err != nil {
+		return nil, errors.Wrap(err, "create minio client")
+	}
+
+	return &s3Bucket{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+func (b *s3Bucket) object(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return b.prefix + "/" + key
+}
+
+func (b *s3Bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := b.client.GetObjectWithContext(ctx, b.bucket, b.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", key)
+	}
+	return obj, nil
+}
+
+func (b *s3Bucket) Upload(ctx context.Context, key string, r io.Reader) error {
+	_, err := b.client.PutObjectWithContext(ctx, b.bucket, b.object(key), r, -1, minio.PutObjectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "put %s", key)
+	}
+	return nil
+}
+
+func (b *s3Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	// minio-go v6 has no context-aware stat call; StatObjectWithContext
+	// was only added in v7.
+	_, err := b.client.StatObject(b.bucket, b.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "stat %s", key)
+	}
+	return true, nil
+}
+
+func (b *s3Bucket) Iter(ctx context.Context, prefix string, fn func(name string) error) error {
+	full := b.object(prefix)
+	if full != "" && !strings.HasSuffix(full, "/") {
+		full += "/"
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for obj := range b.client.ListObjectsV2(b.bucket, full, false, done) {
+		if obj.Err != nil {
+			return errors.Wrap(obj.Err, "list objects")
+		}
+		name := strings.TrimPrefix(obj.Key, full)
+		if name == "" {
+			continue
+		}
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
@@ -8,18 +9,20 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	gokitlog "github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb"
-	"github.com/prometheus/tsdb/chunkenc"
-	"github.com/prometheus/tsdb/chunks"
-	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/ryotarai/prom-downsampler/bucket"
 )
 
+// thanosSource identifies this tool's output blocks in a Thanos bucket.
+const thanosSource = "downsampler"
+
 func main() {
 	err := _main()
 	if err != nil {
@@ -29,9 +32,14 @@ func main() {
 
 func _main() error {
 	logger := gokitlog.NewLogfmtLogger(os.Stderr)
+	ctx := context.Background()
 
-	inputPath := flag.String("input", "", "path to input block")
+	var inputPaths stringsFlag
+	flag.Var(&inputPaths, "input", "path to an input block (repeatable); multiple blocks are merged into one output block")
 	outputDir := flag.String("output", "", "path to output blocks dir")
+	inputBucketURL := flag.String("input-bucket", "", "bucket URL to read candidate blocks from, e.g. s3://bucket/prefix")
+	outputBucketURL := flag.String("output-bucket", "", "bucket URL to upload the output block to, e.g. s3://bucket/prefix")
+	dryRun := flag.Bool("dry-run", false, "list candidate blocks in -input-bucket without writing anything")
 	intervalStr := flag.String("interval", "", "sampling interval")
 	flag.Parse()
 
@@ -39,170 +47,170 @@ func _main() error {
 	if err != nil {
 		return errors.Wrap(err, "parsing interval")
 	}
+	intervalMs := interval.Nanoseconds() / 1000 / 1000
 
-	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-	uid := ulid.MustNew(ulid.Now(), entropy)
-	outputPath := filepath.Join(*outputDir, uid.String())
+	var outputBkt bucket.Bucket
+	if *outputBucketURL != "" {
+		outputBkt, err = bucket.New(*outputBucketURL)
+		if err != nil {
+			return errors.Wrap(err, "open output bucket")
+		}
+	}
 
-	log.Printf("[INFO] Downsampling a block at %s", *inputPath)
+	if *outputDir == "" {
+		tmpDir, err := ioutil.TempDir("", "prom-downsampler-output")
+		if err != nil {
+			return errors.Wrap(err, "create a temp dir for the output block")
+		}
+		defer os.RemoveAll(tmpDir)
+		*outputDir = tmpDir
+	}
 
-	err = os.Mkdir(outputPath, 0777)
-	if err != nil {
-		return errors.Wrap(err, "os.Mkdir")
+	ranAny := false
+
+	// -input blocks are an explicit request to merge: downsample them
+	// together into a single output block (chunk0-3's multi-input case).
+	if len(inputPaths) > 0 {
+		if err := downsampleBlock(ctx, logger, inputPaths, *outputDir, intervalMs, outputBkt); err != nil {
+			return errors.Wrap(err, "downsample -input blocks")
+		}
+		ranAny = true
 	}
 
-	block, err := tsdb.OpenBlock(logger, *inputPath, chunkenc.NewPool())
-	if err != nil {
-		return errors.Wrap(err, "open block")
+	// -input-bucket discovers blocks that haven't been downsampled to this
+	// resolution yet. Each candidate is its own downsampling run with its
+	// own output block - bucket discovery never implicitly merges blocks,
+	// since a bucket can hold many unrelated, non-overlapping blocks.
+	if *inputBucketURL != "" {
+		inputBkt, err := bucket.New(*inputBucketURL)
+		if err != nil {
+			return errors.Wrap(err, "open input bucket")
+		}
+
+		candidates, err := candidateBlocks(ctx, inputBkt, intervalMs)
+		if err != nil {
+			return errors.Wrap(err, "list candidate blocks")
+		}
+
+		if *dryRun {
+			for _, name := range candidates {
+				log.Printf("[INFO] candidate: %s", name)
+			}
+			return nil
+		}
+
+		for _, name := range candidates {
+			if err := downsampleCandidate(ctx, logger, inputBkt, name, *outputDir, intervalMs, outputBkt); err != nil {
+				return errors.Wrapf(err, "downsample candidate %s", name)
+			}
+		}
+		ranAny = true
 	}
-	defer block.Close()
 
-	indexr, err := block.Index()
-	if err != nil {
-		return errors.Wrap(err, "open index reader")
+	if !ranAny {
+		return errors.New("no input blocks: pass -input or -input-bucket")
 	}
-	defer indexr.Close()
 
-	indexw, err := index.NewWriter(filepath.Join(outputPath, "index"))
+	return nil
+}
+
+// downsampleCandidate fetches a single block discovered in an input
+// bucket into a scratch directory, downsamples it on its own, and cleans
+// the scratch directory up again, keeping bucket discovery from holding
+// more than one candidate's raw data on local disk at a time.
+func downsampleCandidate(ctx context.Context, logger gokitlog.Logger, inputBkt bucket.Bucket, name, outputDir string, intervalMs int64, outputBkt bucket.Bucket) error {
+	tmpDir, err := ioutil.TempDir("", "prom-downsampler-input")
 	if err != nil {
-		return errors.Wrap(err, "open index writer")
+		return errors.Wrap(err, "create a temp dir for the input block")
 	}
-	defer indexw.Close()
+	defer os.RemoveAll(tmpDir)
 
-	chunkr, err := block.Chunks()
+	localDir, err := fetchBlock(ctx, inputBkt, name, tmpDir)
 	if err != nil {
-		return errors.Wrap(err, "open chunk reader")
+		return errors.Wrapf(err, "fetch block %s", name)
 	}
-	defer chunkr.Close()
 
-	postings, err := indexr.Postings(index.AllPostingsKey())
-	if err != nil {
-		return errors.Wrap(err, "list all postings")
+	return downsampleBlock(ctx, logger, []string{localDir}, outputDir, intervalMs, outputBkt)
+}
+
+// downsampleBlock merges inputPaths (usually one block, or several when
+// the caller explicitly asked to combine them) into a single downsampled
+// output block under outputDir, and uploads it to outputBkt if non-nil.
+func downsampleBlock(ctx context.Context, logger gokitlog.Logger, inputPaths []string, outputDir string, intervalMs int64, outputBkt bucket.Bucket) error {
+	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+	uid := ulid.MustNew(ulid.Now(), entropy)
+	outputPath := filepath.Join(outputDir, uid.String())
+
+	log.Printf("[INFO] Downsampling %d block(s): %v", len(inputPaths), inputPaths)
+
+	if err := os.Mkdir(outputPath, 0777); err != nil {
+		return errors.Wrap(err, "os.Mkdir")
 	}
 
-	chunkw, err := chunks.NewWriter(filepath.Join(outputPath, "chunks"))
+	blocks, err := openBlocks(logger, inputPaths)
 	if err != nil {
-		return errors.Wrap(err, "create a chunk writer")
+		return errors.Wrap(err, "open input blocks")
 	}
+	defer closeBlocks(blocks)
 
-	symbols, err := indexr.Symbols()
+	merged, err := mergeSeries(blocks)
 	if err != nil {
-		return errors.Wrap(err, "get symbols in an index")
+		return errors.Wrap(err, "merge series across input blocks")
 	}
 
-	err = indexw.AddSymbols(symbols)
+	sw, err := NewStreamingWriter(outputPath)
 	if err != nil {
-		return errors.Wrap(err, "add symbols in an index")
+		return errors.Wrap(err, "create a streaming writer")
 	}
+	defer sw.Close()
 
-	var globalMaxTime int64
-
-	toPostings := index.NewMemPostings()
-	for postings.Next() {
-		indexRef := postings.At()
-
-		lset := labels.Labels{}
-		chks := []chunks.Meta{}
-		err = indexr.Series(indexRef, &lset, &chks)
+	for _, series := range merged {
+		aggrs, err := aggregateSeries(series.sources, intervalMs)
 		if err != nil {
-			return errors.Wrap(err, "get a series")
+			return errors.Wrap(err, "aggregate a series")
 		}
-
-		toPostings.Add(indexRef, lset)
-
-		// log.Printf("labels: %+v, chunks: %+v", lset, chks)
-
-		newChunk := chunkenc.NewXORChunk()
-		chunkAppender, err := newChunk.Appender()
-		if err != nil {
-			return errors.Wrap(err, "create a chunk appender")
+		if aggrs == nil {
+			continue
 		}
 
-		var maxTime int64
-		var minTime int64
-		for _, chk := range chks {
-			c, err := chunkr.Chunk(chk.Ref)
-			if err != nil {
-				return errors.Wrap(err, "get a chunk")
-			}
+		for _, name := range aggrNames {
+			m := aggrs[name]
 
-			iter := c.Iterator()
-			for iter.Next() {
-				t, v := iter.At()
-				if maxTime == 0 || maxTime+interval.Nanoseconds()/1000/1000 <= t {
-					chunkAppender.Append(t, v)
-					// log.Printf("t:%d, v:%f", t, v)
-					maxTime = t
-					if minTime == 0 {
-						minTime = t
-					}
-					if globalMaxTime < t {
-						globalMaxTime = t
-					}
-				}
-			}
-			if err := iter.Err(); err != nil {
-				return errors.Wrap(err, "iterate a chunk")
-			}
-		}
+			aggrLset := make(labels.Labels, 0, len(series.lset)+1)
+			aggrLset = append(aggrLset, series.lset...)
+			aggrLset = append(aggrLset, labels.Label{Name: aggrLabelName, Value: name})
+			sort.Sort(aggrLset)
 
-		m := []chunks.Meta{{
-			MinTime: minTime,
-			MaxTime: maxTime,
-			Chunk:   newChunk,
-		}}
-		err = chunkw.WriteChunks(m...)
-		if err != nil {
-			return errors.Wrap(err, "write a chunk")
-		}
-
-		err = indexw.AddSeries(indexRef, lset, m...)
-		if err != nil {
-			return errors.Wrap(err, "write a series to an index")
+			if err := sw.AddSeries(aggrLset, m); err != nil {
+				return errors.Wrap(err, "add a series")
+			}
 		}
 	}
-	if err := postings.Err(); err != nil {
-		return errors.Wrap(err, "iterate postings")
-	}
 
-	if err := chunkw.Close(); err != nil {
-		return errors.Wrap(err, "close a chunk writer")
+	if err := sw.Flush(); err != nil {
+		return errors.Wrap(err, "flush the streaming writer")
 	}
 
-	sortedKeys := toPostings.SortedKeys()
-
-	var name string
-	values := []string{}
-	for _, l := range sortedKeys {
-		if l.Name == "" && l.Value == "" {
-			continue
-		}
-		if name == "" { // first time
-			name = l.Name
-		}
-		if l.Name != name && len(values) > 0 {
-			indexw.WriteLabelIndex([]string{name}, values)
-			name = l.Name
-			values = []string{}
-		}
-		values = append(values, l.Value)
-	}
-	if len(values) > 0 {
-		indexw.WriteLabelIndex([]string{name}, values)
+	// Tombstoned samples were already dropped while aggregating, so the
+	// output block has nothing left to delete - but it still needs a
+	// (empty) tombstone file for tsdb.OpenBlock to accept it cleanly.
+	if err := writeEmptyTombstoneFile(outputPath); err != nil {
+		return errors.Wrap(err, "write tombstone file")
 	}
 
-	for _, l := range sortedKeys {
-		err := indexw.WritePostings(l.Name, l.Value, toPostings.Get(l.Name, l.Value))
-		if err != nil {
-			return errors.Wrap(err, "writer.WritePostings")
-		}
-	}
+	minTime, maxTime, sources, level := mergedMeta(blocks)
 
-	meta := block.Meta()
-	meta.ULID = uid
-	meta.MaxTime = globalMaxTime
-	meta.Stats = tsdb.BlockStats{}
-	b, err := json.Marshal(meta)
+	var outMeta blockMeta
+	outMeta.Version = blocks[0].block.Meta().Version
+	outMeta.ULID = uid
+	outMeta.MinTime = minTime
+	outMeta.MaxTime = maxTime
+	outMeta.Stats = tsdb.BlockStats{}
+	outMeta.Compaction.Sources = sources
+	outMeta.Compaction.Level = level
+	outMeta.Thanos.Source = thanosSource
+	outMeta.Thanos.Downsample.Resolution = intervalMs
+	b, err := json.Marshal(outMeta)
 	if err != nil {
 		return errors.Wrap(err, "json.Marshal")
 	}
@@ -213,5 +221,11 @@ func _main() error {
 
 	log.Printf("[INFO] Downsampling completed. A block has been created at %s", outputPath)
 
+	if outputBkt != nil {
+		if err := uploadBlock(ctx, outputBkt, outputPath); err != nil {
+			return errors.Wrap(err, "upload output block")
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// stringsFlag collects repeated occurrences of a flag into a slice, e.g.
+// -input a -input b -input c.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// openBlock is one input block opened for merging.
+type openBlock struct {
+	block      *tsdb.Block
+	indexr     tsdb.IndexReader
+	chunkr     tsdb.ChunkReader
+	tombstones tsdb.TombstoneReader
+}
+
+func openBlocks(logger gokitlog.Logger, paths []string) ([]*openBlock, error) {
+	blocks := make([]*openBlock, 0, len(paths))
+	for _, p := range paths {
+		block, err := tsdb.OpenBlock(logger, p, chunkenc.NewPool())
+		if err != nil {
+			return nil, errors.Wrapf(err, "open block %s", p)
+		}
+
+		indexr, err := block.Index()
+		if err != nil {
+			return nil, errors.Wrapf(err, "open index reader for %s", p)
+		}
+
+		chunkr, err := block.Chunks()
+		if err != nil {
+			return nil, errors.Wrapf(err, "open chunk reader for %s", p)
+		}
+
+		tr, err := block.Tombstones()
+		if err != nil {
+			return nil, errors.Wrapf(err, "open tombstone reader for %s", p)
+		}
+
+		blocks = append(blocks, &openBlock{block: block, indexr: indexr, chunkr: chunkr, tombstones: tr})
+	}
+	return blocks, nil
+}
+
+func closeBlocks(blocks []*openBlock) {
+	for _, b := range blocks {
+		b.tombstones.Close()
+		b.chunkr.Close()
+		b.indexr.Close()
+		b.block.Close()
+	}
+}
+
+// mergedSeries is one output series: the union of every input block's
+// contribution for a given label set. Per-block chunk ranges for the same
+// series must not overlap in time (mergeSeries rejects inputs that do),
+// so ordering chunkSources by the MinTime of the series' first chunk in
+// each block and chaining - not interleaving - their chunk iterators is
+// sufficient.
+type mergedSeries struct {
+	lset    labels.Labels
+	sources []chunkSource
+}
+
+// mergeSeries reads every series out of every input block and groups
+// series with identical label sets across blocks together, returning
+// them sorted by label set. It returns an error if two input blocks hold
+// overlapping time ranges for the same series, since aggregateSeries
+// requires strictly increasing timestamps across chunk sources and has
+// no way to deduplicate or interleave overlapping samples.
+func mergeSeries(blocks []*openBlock) ([]mergedSeries, error) {
+	type entry struct {
+		lset    labels.Labels
+		src     chunkSource
+		minTime int64
+		maxTime int64
+	}
+
+	var entries []entry
+	for _, b := range blocks {
+		postings, err := b.indexr.Postings(index.AllPostingsKey())
+		if err != nil {
+			return nil, errors.Wrap(err, "list all postings")
+		}
+
+		for postings.Next() {
+			ref := postings.At()
+
+			lset := labels.Labels{}
+			chks := []chunks.Meta{}
+			if err := b.indexr.Series(ref, &lset, &chks); err != nil {
+				return nil, errors.Wrap(err, "get a series")
+			}
+			if len(chks) == 0 {
+				continue
+			}
+
+			ivs, err := b.tombstones.Get(ref)
+			if err != nil {
+				return nil, errors.Wrap(err, "get tombstones for a series")
+			}
+
+			entries = append(entries, entry{
+				lset:    lset,
+				src:     chunkSource{reader: b.chunkr, chks: chks, intervals: ivs},
+				minTime: chks[0].MinTime,
+				maxTime: chks[len(chks)-1].MaxTime,
+			})
+		}
+		if err := postings.Err(); err != nil {
+			return nil, errors.Wrap(err, "iterate postings")
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := labelsCompare(entries[i].lset, entries[j].lset); c != 0 {
+			return c < 0
+		}
+		return entries[i].minTime < entries[j].minTime
+	})
+
+	var merged []mergedSeries
+	var prevMaxTime int64
+	for _, e := range entries {
+		n := len(merged)
+		sameSeries := n > 0 && labelsCompare(merged[n-1].lset, e.lset) == 0
+		if sameSeries {
+			if e.minTime <= prevMaxTime {
+				return nil, errors.Errorf(
+					"overlapping input blocks for series %s: one block's samples end at %d, another's begin at %d; merging overlapping blocks is not supported",
+					e.lset, prevMaxTime, e.minTime)
+			}
+			merged[n-1].sources = append(merged[n-1].sources, e.src)
+		} else {
+			merged = append(merged, mergedSeries{lset: e.lset, sources: []chunkSource{e.src}})
+		}
+		prevMaxTime = e.maxTime
+	}
+
+	return merged, nil
+}
+
+// mergedMeta builds the Compaction section of the output block's meta.json
+// from the blocks being merged: Sources is the union of every input
+// block's ULID and Level is one past the deepest input.
+func mergedMeta(blocks []*openBlock) (minTime, maxTime int64, sources []ulid.ULID, level int) {
+	for i, b := range blocks {
+		m := b.block.Meta()
+		if i == 0 || m.MinTime < minTime {
+			minTime = m.MinTime
+		}
+		if m.MaxTime > maxTime {
+			maxTime = m.MaxTime
+		}
+		sources = append(sources, m.ULID)
+		if m.Compaction.Level > level {
+			level = m.Compaction.Level
+		}
+	}
+	level++
+	return
+}
@@ -0,0 +1,26 @@
+package main
+
+import "github.com/prometheus/tsdb"
+
+// blockMeta extends tsdb.BlockMeta with the Thanos-specific fields that
+// downstream Thanos components (store gateway, compactor) look for on
+// blocks living in their bucket, e.g. to recognise a block as already
+// downsampled and avoid re-downsampling it.
+type blockMeta struct {
+	tsdb.BlockMeta
+
+	Thanos thanosMeta `json:"thanos,omitempty"`
+}
+
+type thanosMeta struct {
+	// Source marks the tool that produced the block, so a Thanos bucket
+	// that mixes this tool's output with compactor output can tell them
+	// apart.
+	Source     string               `json:"source,omitempty"`
+	Downsample thanosDownsampleMeta `json:"downsample,omitempty"`
+}
+
+type thanosDownsampleMeta struct {
+	// Resolution is the downsampling interval in milliseconds.
+	Resolution int64 `json:"resolution"`
+}
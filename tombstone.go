@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+)
+
+// tombstoneFilename is the name tsdb.OpenBlock looks for inside a block
+// directory; tombstoneFormatV1 is the only format version it understands.
+// Both are unexported in the tsdb package.
+const (
+	tombstoneFilename = "tombstones"
+	tombstoneFormatV1 = 1
+)
+
+// castagnoliTable is the CRC32 polynomial tsdb's tombstone file format (and
+// its index/WAL formats) checksums with.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// tombstoned reports whether t falls inside any of ivs, which are assumed
+// sorted and non-overlapping as produced by tsdb.TombstoneReader.
+func tombstoned(ivs tsdb.Intervals, t int64) bool {
+	for _, iv := range ivs {
+		if t < iv.Mint {
+			break
+		}
+		if t <= iv.Maxt {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEmptyTombstoneFile writes a tombstones file with no deleted
+// intervals to dir, in the on-disk format tsdb.OpenBlock expects: a
+// 4-byte magic, a 1-byte format version, an empty body (no intervals to
+// downsample ever deletes - tombstoned samples are simply never written
+// to the output block), and a trailing Castagnoli CRC32 checksum of the
+// body. tsdb has no exported way to produce this file directly: both the
+// writer and tsdb.NewMemTombstones' unexported constructor live only
+// inside the tsdb package.
+func writeEmptyTombstoneFile(dir string) error {
+	f, err := os.Create(filepath.Join(dir, tombstoneFilename))
+	if err != nil {
+		return errors.Wrap(err, "create tombstones file")
+	}
+	defer f.Close()
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(tsdb.MagicTombstone))
+	header[4] = tombstoneFormatV1
+	if _, err := f.Write(header[:]); err != nil {
+		return errors.Wrap(err, "write tombstones header")
+	}
+
+	// The body is empty, so the checksum is the Castagnoli CRC32 of zero
+	// bytes.
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(nil, castagnoliTable))
+	if _, err := f.Write(checksum[:]); err != nil {
+		return errors.Wrap(err, "write tombstones checksum")
+	}
+
+	return f.Sync()
+}
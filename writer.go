@@ -0,0 +1,172 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// bufferedSeries is the lightweight per-series index entry StreamingWriter
+// keeps around between AddSeries and Flush. The chunk data itself is
+// already on disk by the time this is held, so this only costs a label
+// set and a handful of chunk refs per series. ref is assigned in Flush,
+// once the final sorted order is known, not at AddSeries time.
+type bufferedSeries struct {
+	lset   labels.Labels
+	chunks []chunks.Meta
+}
+
+// StreamingWriter writes a TSDB block without holding the whole block in
+// memory. Chunks are encoded and appended to the chunks file as soon as
+// AddSeries is called; only the symbol set and the (small) per-series
+// index entries accumulate until Flush, so memory is roughly chunk-file
+// buffering plus the symbol set and index entry buffer. The latter two
+// grow with the number of series; chunk data does not.
+type StreamingWriter struct {
+	indexw *index.Writer
+	chunkw *chunks.Writer
+
+	symbols  map[string]struct{}
+	postings *index.MemPostings
+	series   []bufferedSeries
+}
+
+// NewStreamingWriter creates the index and chunks files for a block at
+// outputPath and returns a writer ready to accept series.
+func NewStreamingWriter(outputPath string) (*StreamingWriter, error) {
+	indexw, err := index.NewWriter(filepath.Join(outputPath, "index"))
+	if err != nil {
+		return nil, errors.Wrap(err, "open index writer")
+	}
+
+	chunkw, err := chunks.NewWriter(filepath.Join(outputPath, "chunks"))
+	if err != nil {
+		return nil, errors.Wrap(err, "create a chunk writer")
+	}
+
+	return &StreamingWriter{
+		indexw:   indexw,
+		chunkw:   chunkw,
+		symbols:  map[string]struct{}{},
+		postings: index.NewMemPostings(),
+	}, nil
+}
+
+// AddSeries encodes and appends chks to the chunks file immediately, then
+// buffers lset/chunk-meta for a later Flush. chks is mutated in place with
+// the refs chunks.Writer assigns, matching chunks.Writer.WriteChunks. The
+// encoded Chunk payloads themselves are dropped once on disk - only
+// Ref/MinTime/MaxTime are needed to write the index later - so buffered
+// series don't keep the block's chunk data resident in memory.
+//
+// Series refs are not assigned here: index.Writer.AddSeries and postings
+// both require series to be added in sorted label order with ascending
+// refs, and AddSeries can be called in any order, so ref assignment is
+// deferred to Flush, after the buffered series have been sorted.
+func (w *StreamingWriter) AddSeries(lset labels.Labels, chks ...chunks.Meta) error {
+	if err := w.chunkw.WriteChunks(chks...); err != nil {
+		return errors.Wrap(err, "write chunks")
+	}
+	for i := range chks {
+		chks[i].Chunk = nil
+	}
+
+	for _, l := range lset {
+		w.symbols[l.Name] = struct{}{}
+		w.symbols[l.Value] = struct{}{}
+	}
+
+	w.series = append(w.series, bufferedSeries{lset: lset, chunks: chks})
+
+	return nil
+}
+
+// Flush closes the chunks file, writes the symbol table built up from
+// every AddSeries call so far, replays the buffered series into the
+// index writer in sorted order, then writes label indices, postings and
+// meta.json-adjacent index structures. The caller is still responsible
+// for writing meta.json and for calling Close.
+func (w *StreamingWriter) Flush() error {
+	if err := w.chunkw.Close(); err != nil {
+		return errors.Wrap(err, "close a chunk writer")
+	}
+
+	if err := w.indexw.AddSymbols(w.symbols); err != nil {
+		return errors.Wrap(err, "add symbols in an index")
+	}
+
+	sort.Slice(w.series, func(i, j int) bool {
+		return labelsCompare(w.series[i].lset, w.series[j].lset) < 0
+	})
+
+	for i, s := range w.series {
+		ref := uint64(i + 1)
+		if err := w.indexw.AddSeries(ref, s.lset, s.chunks...); err != nil {
+			return errors.Wrap(err, "write a series to an index")
+		}
+		w.postings.Add(ref, s.lset)
+	}
+
+	sortedKeys := w.postings.SortedKeys()
+
+	var name string
+	values := []string{}
+	for _, l := range sortedKeys {
+		if l.Name == "" && l.Value == "" {
+			continue
+		}
+		if name == "" { // first time
+			name = l.Name
+		}
+		if l.Name != name && len(values) > 0 {
+			if err := w.indexw.WriteLabelIndex([]string{name}, values); err != nil {
+				return errors.Wrap(err, "write a label index")
+			}
+			name = l.Name
+			values = []string{}
+		}
+		values = append(values, l.Value)
+	}
+	if len(values) > 0 {
+		if err := w.indexw.WriteLabelIndex([]string{name}, values); err != nil {
+			return errors.Wrap(err, "write a label index")
+		}
+	}
+
+	for _, l := range sortedKeys {
+		if err := w.indexw.WritePostings(l.Name, l.Value, w.postings.Get(l.Name, l.Value)); err != nil {
+			return errors.Wrap(err, "write postings")
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying index writer. Call it after Flush.
+func (w *StreamingWriter) Close() error {
+	return w.indexw.Close()
+}
+
+// labelsCompare orders two label sets the same way MemPostings.SortedKeys
+// orders label/value pairs: lexicographically by name, then by value.
+func labelsCompare(a, b labels.Labels) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
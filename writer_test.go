@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// BenchmarkStreamingWriterMemory feeds b.N synthetic single-sample series
+// through AddSeries and samples heap usage as it goes. Run with
+// -bench=StreamingWriterMemory -benchtime=10000000x to reproduce the
+// 10M-series scenario. Heap usage grows with b.N only by each series'
+// buffered index entry and new symbols, not by its chunk data, since
+// AddSeries drops each series' encoded chunk payload once it has been
+// written to the chunks file rather than keeping it resident until Flush.
+func BenchmarkStreamingWriterMemory(b *testing.B) {
+	dir, err := ioutil.TempDir("", "prom-downsampler-bench")
+	if err != nil {
+		b.Fatalf("create a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw, err := NewStreamingWriter(dir)
+	if err != nil {
+		b.Fatalf("NewStreamingWriter: %s", err)
+	}
+	defer sw.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			b.Fatalf("create a chunk appender: %s", err)
+		}
+		app.Append(int64(i), float64(i))
+
+		lset := labels.Labels{
+			{Name: "__name__", Value: "bench_metric"},
+			{Name: "series", Value: fmt.Sprintf("%d", i)},
+		}
+		chk := chunks.Meta{Chunk: c, MinTime: int64(i), MaxTime: int64(i)}
+		if err := sw.AddSeries(lset, chk); err != nil {
+			b.Fatalf("AddSeries: %s", err)
+		}
+
+		if i%1000 == 0 {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			b.ReportMetric(float64(m.HeapAlloc), "heap_bytes")
+		}
+	}
+}